@@ -7,90 +7,351 @@ import (
 	"time"
 )
 
+// State represents the tri-state status of a CircuitBreaker.
+type State int64
+
+const (
+	// Closed means events are flowing normally and the rate is being sampled.
+	Closed State = iota
+	// Open means the breaker has tripped; callers should treat IsOpen() as
+	// a signal to stop processing until it recovers (or Reset() is called).
+	Open
+	// HalfOpen means the grace period following a trip has elapsed and the
+	// breaker is probing whether the event rate has recovered.
+	HalfOpen
+)
+
+// String implements fmt.Stringer for use in logs and telemetry.
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
 const (
-	tickInterval  = 1 * time.Second
-	breakerOpen   = int64(1)
-	breakerClosed = int64(1)
-
-	// The lower this number is the more amortized the average is
-	// For example, if ewmaWeight is 1, a single burst of events might
-	// cause the breaker to trip.
-	ewmaWeight = 0.2
+	// defaultWindow is the trailing interval the rate is computed over.
+	defaultWindow = 10 * time.Second
+	// defaultGranularity is the number of buckets defaultWindow is split into.
+	defaultGranularity = 10
 )
 
 // CircuitBreaker is meant to enforce a maximum rate of events per second
-// Once the event rate goes above the threshold the circuit breaker will trip
-// and remain open until Reset() is called.
+// Once the event rate goes above the threshold the circuit breaker will trip.
+// By default it stays open until Reset() is called; if GraceDuration is set
+// it will instead probe for recovery by transitioning to HalfOpen, and if
+// DoomDuration is set it gives up on auto-recovery after that long and
+// requires an explicit Reset().
+//
+// The event rate is estimated from a ring of buckets covering a trailing
+// window, rather than a single EWMA, so that a short severe burst trips the
+// breaker within one bucket instead of being smoothed away.
+//
+// A CircuitBreaker starts a background goroutine on construction; call
+// Stop() when done with it to release the ticker and exit the goroutine.
 type CircuitBreaker struct {
 	// The maximum rate of events allowed to pass
 	maxEventsPerSec int
 
-	// The number of events elapsed since the last tick
-	eventCount int64
+	// How long to wait after tripping before probing for recovery via
+	// HalfOpen. Zero disables auto-recovery (today's fail-closed behavior).
+	graceDuration time.Duration
+
+	// How long the breaker may stay open before it gives up on
+	// auto-recovery and requires an explicit Reset(). Zero disables this.
+	doomDuration time.Duration
+
+	// buckets is a ring covering the trailing window; each holds the event
+	// count accumulated during its slice of the window.
+	buckets []atomic.Int64
+	// writeIdx is the index of the bucket currently being written to by Tick
+	writeIdx atomic.Int64
+	// runningSum is kept equal to the sum of all buckets as they're evicted,
+	// so the current rate can be read in O(1).
+	runningSum atomic.Int64
+
+	window      time.Duration
+	granularity int
 
-	// An exponentially weighted average of the event rate (per second)
-	// This is what actually compare against maxEventsPersec
-	eventRate int64
+	// startedAt is the timestamp in nanoseconds of when the ring began
+	// accumulating its current trailing window, i.e. construction or the
+	// last Reset(). Until window has actually elapsed since then the ring
+	// isn't fully populated yet, so the rate must be normalized by how long
+	// it's actually been accumulating rather than by the configured window.
+	startedAt atomic.Int64
 
-	// Represents the status of the cicuit breaker.
-	// 1 means open, 0 means closed
-	status int64
+	// rate is the most recently computed events-per-second estimate
+	rate atomic.Int64
 
-	// The timestamp in nanoseconds of when we last updated eventRate
-	lastUpdate int64
+	// status holds the current State (Closed/Open/HalfOpen)
+	status atomic.Int64
+
+	// openedAt is the timestamp in nanoseconds of when the breaker last
+	// tripped open
+	openedAt atomic.Int64
+
+	// doomed is set once the breaker has been open for longer than
+	// doomDuration, at which point it refuses to auto-recover until Reset().
+	doomed atomic.Bool
+
+	// tripped counts transitions into Open, recovered counts transitions
+	// back to Closed, and eventsDropped counts events ticked while Open.
+	// They are read through the Tripped, Recovered and EventsDropped
+	// accessors; they are not registered with any telemetry or expvar endpoint.
+	tripped       atomic.Int64
+	recovered     atomic.Int64
+	eventsDropped atomic.Int64
+
+	onStateChange atomic.Pointer[StateChangeFunc]
+
+	done chan struct{}
+}
+
+// StateChangeFunc is invoked whenever a CircuitBreaker transitions between
+// Closed, Open and HalfOpen, see OnStateChange.
+type StateChangeFunc func(old, new State, rate int64)
+
+// CircuitBreakerOption configures optional recovery behavior of a CircuitBreaker.
+type CircuitBreakerOption func(*CircuitBreaker)
+
+// WithGraceDuration configures how long an open CircuitBreaker waits before
+// probing for recovery by transitioning to HalfOpen. Without this option the
+// breaker never auto-recovers and requires an explicit Reset(), matching the
+// original behavior.
+func WithGraceDuration(d time.Duration) CircuitBreakerOption {
+	return func(c *CircuitBreaker) {
+		c.graceDuration = d
+	}
 }
 
+// WithDoomDuration configures how long a CircuitBreaker may remain open
+// before it gives up on auto-recovery entirely and requires an explicit
+// Reset(). It has no effect unless WithGraceDuration is also set.
+func WithDoomDuration(d time.Duration) CircuitBreakerOption {
+	return func(c *CircuitBreaker) {
+		c.doomDuration = d
+	}
+}
+
+// NewCircuitBreaker returns a CircuitBreaker with today's fail-closed
+// behavior: once tripped it stays open until Reset() is called. Use
+// NewCircuitBreakerWithOptions to enable auto-recovery.
 func NewCircuitBreaker(maxEventsPerSec int) *CircuitBreaker {
-	c := &CircuitBreaker{maxEventsPerSec: maxEventsPerSec}
+	return NewCircuitBreakerWithOptions(maxEventsPerSec)
+}
+
+// NewCircuitBreakerWithOptions is like NewCircuitBreaker but accepts
+// CircuitBreakerOption values to configure auto-recovery.
+func NewCircuitBreakerWithOptions(maxEventsPerSec int, opts ...CircuitBreakerOption) *CircuitBreaker {
+	return NewCircuitBreakerWithGranularity(maxEventsPerSec, defaultWindow, defaultGranularity, opts...)
+}
+
+// NewCircuitBreakerWithGranularity is like NewCircuitBreakerWithOptions but
+// allows the trailing window and bucket count used to estimate the event
+// rate to be overridden. A larger granularity gives finer-grained burst
+// detection at the cost of one extra bucket swap per window/granularity tick.
+func NewCircuitBreakerWithGranularity(maxEventsPerSec int, window time.Duration, granularity int, opts ...CircuitBreakerOption) *CircuitBreaker {
+	c := &CircuitBreaker{
+		maxEventsPerSec: maxEventsPerSec,
+		buckets:         make([]atomic.Int64, granularity),
+		window:          window,
+		granularity:     granularity,
+		done:            make(chan struct{}),
+	}
+	c.startedAt.Store(time.Now().UnixNano())
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	go c.run(window / time.Duration(granularity))
 
-	go func() {
-		ticker := time.NewTicker(1 * time.Second)
-		for t := range ticker.C {
+	return c
+}
+
+func (c *CircuitBreaker) run(stepEvery time.Duration) {
+	ticker := time.NewTicker(stepEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case t := <-ticker.C:
 			c.update(t)
+		case <-c.done:
+			return
 		}
-	}()
+	}
+}
 
-	return c
+// Stop releases the background ticker goroutine started by
+// NewCircuitBreaker. The CircuitBreaker must not be used afterwards.
+func (c *CircuitBreaker) Stop() {
+	close(c.done)
+}
+
+// State returns the current tri-state status of the breaker.
+func (c *CircuitBreaker) State() State {
+	return State(c.status.Load())
+}
+
+// LastOpenedAt returns the timestamp of the last time the breaker tripped
+// open. It is the zero Time if the breaker has never tripped.
+func (c *CircuitBreaker) LastOpenedAt() time.Time {
+	ns := c.openedAt.Load()
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// Rate returns the most recently computed events-per-second rate.
+func (c *CircuitBreaker) Rate() int64 {
+	return c.rate.Load()
+}
+
+// Tripped returns the number of times the breaker has transitioned into Open.
+func (c *CircuitBreaker) Tripped() int64 {
+	return c.tripped.Load()
+}
+
+// Recovered returns the number of times the breaker has transitioned from
+// Open/HalfOpen back to Closed.
+func (c *CircuitBreaker) Recovered() int64 {
+	return c.recovered.Load()
+}
+
+// EventsDropped returns the total number of events passed to Tick while the
+// breaker was Open.
+func (c *CircuitBreaker) EventsDropped() int64 {
+	return c.eventsDropped.Load()
+}
+
+// OnStateChange registers a callback invoked whenever the breaker transitions
+// between Closed, Open and HalfOpen, receiving the rate that was in effect at
+// the time of the transition. Registering a new callback replaces the previous
+// one; pass nil to unregister. Transitions made by the update loop run the
+// callback synchronously on the breaker's background goroutine, so it must not
+// block or it will delay subsequent bucket advances; a transition made by
+// Reset() runs it synchronously on the goroutine that called Reset().
+func (c *CircuitBreaker) OnStateChange(f StateChangeFunc) {
+	if f == nil {
+		c.onStateChange.Store(nil)
+		return
+	}
+	c.onStateChange.Store(&f)
 }
 
 func (c *CircuitBreaker) IsOpen() bool {
-	return atomic.LoadInt64(&c.status) == breakerOpen
+	return c.status.Load() == int64(Open)
 }
 
 func (c *CircuitBreaker) Tick(n int) {
-	atomic.AddInt64(&c.eventCount, int64(n))
+	if c.IsOpen() {
+		c.eventsDropped.Add(int64(n))
+	}
+
+	// Keep feeding the window even while Open: it's what HalfOpen uses to
+	// decide whether to recover, and starting it empty on every recovery
+	// probe would make the rate estimate meaningless until it refills.
+	idx := c.writeIdx.Load()
+	c.buckets[idx].Add(int64(n))
+	c.runningSum.Add(int64(n))
+}
+
+// setState transitions the breaker to s, bumping the Tripped/Recovered
+// counters and notifying the registered OnStateChange callback if the state
+// actually changed.
+func (c *CircuitBreaker) setState(s State, rate int64) {
+	old := State(c.status.Swap(int64(s)))
+	if old == s {
+		return
+	}
+
+	switch s {
+	case Open:
+		c.tripped.Add(1)
+	case Closed:
+		c.recovered.Add(1)
+	}
+
+	if cb := c.onStateChange.Load(); cb != nil {
+		(*cb)(old, s, rate)
+	}
 }
 
+// Reset clears the breaker back to Closed. The Tripped/Recovered/
+// EventsDropped counters are cumulative telemetry and are not cleared.
 func (c *CircuitBreaker) Reset() {
-	atomic.StoreInt64(&c.eventCount, 0)
-	atomic.StoreInt64(&c.status, breakerClosed)
-	atomic.StoreInt64(&c.eventRate, 0)
-	atomic.StoreInt64(&c.lastUpdate, time.Now().UnixNano())
+	for i := range c.buckets {
+		c.buckets[i].Store(0)
+	}
+	c.runningSum.Store(0)
+	c.rate.Store(0)
+	c.openedAt.Store(0)
+	c.doomed.Store(false)
+	c.startedAt.Store(time.Now().UnixNano())
+	c.setState(Closed, 0)
+}
+
+// advanceBucket evicts the oldest bucket in the ring and starts Tick writing
+// to it again, keeping runningSum equal to the sum over the trailing window.
+func (c *CircuitBreaker) advanceBucket() {
+	idx := c.writeIdx.Load()
+	next := (idx + 1) % int64(len(c.buckets))
+	evicted := c.buckets[next].Swap(0)
+	c.runningSum.Add(-evicted)
+	c.writeIdx.Store(next)
 }
 
 func (c *CircuitBreaker) update(now time.Time) {
-	if c.IsOpen() {
+	c.advanceBucket()
+
+	state := c.State()
+	if state == Open {
+		if c.graceDuration == 0 || c.doomed.Load() {
+			return
+		}
+
+		openedAt := time.Unix(0, c.openedAt.Load())
+		sinceOpened := now.Sub(openedAt)
+		if c.doomDuration > 0 && sinceOpened >= c.doomDuration {
+			// Doomed: refuse to auto-recover, Reset() is now required.
+			c.doomed.Store(true)
+			return
+		}
+		if sinceOpened < c.graceDuration {
+			return
+		}
+
+		// Grace period elapsed: start probing for recovery.
+		c.setState(HalfOpen, c.rate.Load())
 		return
 	}
 
-	lastUpdate := atomic.LoadInt64(&c.lastUpdate)
-	deltaInSec := float64(now.UnixNano()-lastUpdate) / float64(time.Second.Nanoseconds())
-	if deltaInSec < 1.0 {
-		// This is to avoid a divide by 0 panic or a spike due
-		// to a reset followed immeditialy by an update call
-		return
+	// Normalize by how long the ring has actually been accumulating, capped
+	// at the configured window: right after construction/Reset() the ring
+	// isn't full yet, and dividing by the full window regardless would
+	// dilute an early burst by up to windowSec/elapsedSec and let it slip
+	// under maxEventsPerSec.
+	elapsed := now.Sub(time.Unix(0, c.startedAt.Load()))
+	if elapsed > c.window {
+		elapsed = c.window
+	} else if elapsed <= 0 {
+		elapsed = c.window / time.Duration(c.granularity)
 	}
 
-	// Calculate the event rate (EWMA)
-	eventCount := atomic.SwapInt64(&c.eventCount, 0)
-	prevEventRate := atomic.LoadInt64(&c.eventRate)
-	newEventRate := ewmaWeight*float64(eventCount)/deltaInSec + (1-ewmaWeight)*float64(prevEventRate)
+	rate := c.runningSum.Load() * int64(time.Second) / int64(elapsed)
+	c.rate.Store(rate)
 
-	// Update circuit breaker status accordingly
-	if int(newEventRate) > c.maxEventsPerSec {
-		atomic.StoreInt64(&c.status, breakerOpen)
+	if int(rate) > c.maxEventsPerSec {
+		c.openedAt.Store(now.UnixNano())
+		c.setState(Open, rate)
+	} else if state == HalfOpen {
+		c.setState(Closed, rate)
 	}
-
-	atomic.StoreInt64(&c.lastUpdate, now.UnixNano())
-	atomic.StoreInt64(&c.eventRate, int64(newEventRate))
 }
@@ -0,0 +1,234 @@
+// +build linux_bpf
+
+package netlink
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTripsOnBurstWithinOneBucket(t *testing.T) {
+	// With granularity 10 over a 10s window, each bucket spans 1s, so the
+	// finest burst this setup can resolve is "5000 events within 1s" i.e.
+	// 5000 eps. Diluted over the full 10s window that's only 500 eps (and
+	// the old EWMA with weight 0.2 saw 1000 eps), so it would never trip at this
+	// threshold; normalizing by how long the ring has actually been
+	// accumulating catches it on the very first bucket instead.
+	const maxEventsPerSec = 3000
+
+	cb := NewCircuitBreakerWithGranularity(maxEventsPerSec, 10*time.Second, 10)
+
+	cb.Tick(5000)
+
+	if cb.IsOpen() {
+		t.Fatal("breaker should not trip before the next bucket tick")
+	}
+
+	time.Sleep(1200 * time.Millisecond)
+
+	if !cb.IsOpen() {
+		t.Fatalf("breaker should have tripped on the burst within one bucket, rate=%d", cb.Rate())
+	}
+
+	cb.Stop()
+}
+
+func TestCircuitBreakerHalfOpenRecoversAfterQuietPeriod(t *testing.T) {
+	const maxEventsPerSec = 5
+	grace := 150 * time.Millisecond
+
+	cb := NewCircuitBreakerWithGranularity(maxEventsPerSec, 300*time.Millisecond, 3, WithGraceDuration(grace))
+	defer cb.Stop()
+
+	cb.Tick(2000)
+	time.Sleep(150 * time.Millisecond)
+
+	if !cb.IsOpen() {
+		t.Fatalf("expected breaker to trip on burst, state=%v rate=%d", cb.State(), cb.Rate())
+	}
+
+	// Stay quiet past the grace period: the next tick should probe via
+	// HalfOpen and, seeing no further events, recover to Closed.
+	time.Sleep(grace + 450*time.Millisecond)
+
+	if cb.State() != Closed {
+		t.Fatalf("expected breaker to recover to Closed after a quiet period, state=%v rate=%d", cb.State(), cb.Rate())
+	}
+}
+
+func TestCircuitBreakerHalfOpenRetripsUnderContinuedOverload(t *testing.T) {
+	const maxEventsPerSec = 5
+	grace := 150 * time.Millisecond
+
+	cb := NewCircuitBreakerWithGranularity(maxEventsPerSec, 300*time.Millisecond, 3, WithGraceDuration(grace))
+	defer cb.Stop()
+
+	cb.Tick(2000)
+	time.Sleep(150 * time.Millisecond)
+
+	if !cb.IsOpen() {
+		t.Fatalf("expected breaker to trip on burst")
+	}
+	firstOpenedAt := cb.LastOpenedAt()
+
+	// Keep the overload going through the grace period and the HalfOpen
+	// probe that follows it, so the breaker should re-trip and reset
+	// openedAt instead of settling on Closed.
+	done := time.After(grace + 500*time.Millisecond)
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			cb.Tick(2000)
+		case <-done:
+			break loop
+		}
+	}
+
+	if !cb.IsOpen() {
+		t.Fatalf("expected breaker to re-trip under sustained overload, state=%v", cb.State())
+	}
+	if !cb.LastOpenedAt().After(firstOpenedAt) {
+		t.Fatalf("expected openedAt to be reset on re-trip: first=%v last=%v", firstOpenedAt, cb.LastOpenedAt())
+	}
+}
+
+func TestCircuitBreakerDoomStaysOpenPermanently(t *testing.T) {
+	const maxEventsPerSec = 5
+	grace := 400 * time.Millisecond
+	doom := 150 * time.Millisecond
+
+	cb := NewCircuitBreakerWithGranularity(maxEventsPerSec, 300*time.Millisecond, 3,
+		WithGraceDuration(grace), WithDoomDuration(doom))
+	defer cb.Stop()
+
+	cb.Tick(2000)
+	time.Sleep(150 * time.Millisecond)
+
+	if !cb.IsOpen() {
+		t.Fatalf("expected breaker to trip on burst")
+	}
+
+	// Quiet now. Grace (400ms) would otherwise allow a recovery probe, but
+	// DoomDuration (150ms) elapses first and should latch the breaker open
+	// until an explicit Reset().
+	time.Sleep(600 * time.Millisecond)
+
+	if cb.State() != Open {
+		t.Fatalf("expected breaker to remain permanently Open once doomed, state=%v", cb.State())
+	}
+
+	cb.Reset()
+	if cb.State() != Closed {
+		t.Fatalf("expected Reset() to clear doomed state back to Closed, state=%v", cb.State())
+	}
+}
+
+func TestCircuitBreakerStopReleasesRunGoroutine(t *testing.T) {
+	runtime.GC()
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 20; i++ {
+		cb := NewCircuitBreakerWithGranularity(1000, 100*time.Millisecond, 2)
+		cb.Stop()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		runtime.GC()
+		after := runtime.NumGoroutine()
+		if after <= before {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutine count grew from %d to %d after 20 construct/Stop cycles; run() is leaking", before, after)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestCircuitBreakerOnStateChangeAndCounters(t *testing.T) {
+	const maxEventsPerSec = 5
+	grace := 100 * time.Millisecond
+
+	cb := NewCircuitBreakerWithGranularity(maxEventsPerSec, 300*time.Millisecond, 3, WithGraceDuration(grace))
+	defer cb.Stop()
+
+	var mu sync.Mutex
+	var transitions []string
+	cb.OnStateChange(func(old, new State, rate int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		transitions = append(transitions, fmt.Sprintf("%s->%s", old, new))
+	})
+
+	cb.Tick(2000)
+	time.Sleep(150 * time.Millisecond)
+
+	if !cb.IsOpen() {
+		t.Fatalf("expected breaker to trip, state=%v rate=%d", cb.State(), cb.Rate())
+	}
+	if got := cb.Tripped(); got != 1 {
+		t.Fatalf("expected Tripped()==1, got %d", got)
+	}
+
+	// Quiet period: should recover Closed<-HalfOpen<-Open.
+	time.Sleep(grace + 450*time.Millisecond)
+
+	if cb.State() != Closed {
+		t.Fatalf("expected breaker to recover to Closed, state=%v", cb.State())
+	}
+	if got := cb.Recovered(); got != 1 {
+		t.Fatalf("expected Recovered()==1, got %d", got)
+	}
+
+	mu.Lock()
+	got := append([]string(nil), transitions...)
+	mu.Unlock()
+
+	want := []string{"closed->open", "open->half-open", "half-open->closed"}
+	if len(got) != len(want) {
+		t.Fatalf("expected transitions %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected transitions %v, got %v", want, got)
+		}
+	}
+
+	// Reset() on an Open breaker should also route through setState, firing
+	// the callback and bumping Recovered, per 417b24b.
+	cb.Tick(2000)
+	time.Sleep(150 * time.Millisecond)
+	if !cb.IsOpen() {
+		t.Fatalf("expected breaker to re-trip before Reset()")
+	}
+
+	// A handful of events arriving while Open should count as dropped.
+	cb.Tick(5)
+	if got := cb.EventsDropped(); got != 5 {
+		t.Fatalf("expected EventsDropped()==5, got %d", got)
+	}
+
+	cb.Reset()
+
+	if cb.State() != Closed {
+		t.Fatalf("expected Reset() to close the breaker, state=%v", cb.State())
+	}
+	if got := cb.Recovered(); got != 2 {
+		t.Fatalf("expected Recovered()==2 after Reset(), got %d", got)
+	}
+
+	mu.Lock()
+	got = append([]string(nil), transitions...)
+	mu.Unlock()
+
+	if len(got) == 0 || got[len(got)-1] != "open->closed" {
+		t.Fatalf("expected Reset() to fire an open->closed transition callback, got %v", got)
+	}
+}